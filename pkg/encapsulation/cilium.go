@@ -0,0 +1,165 @@
+// Copyright 2019 the Kilo authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encapsulation
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/squat/kilo/pkg/iptables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ciliumHostDeviceName  = "cilium_host"
+	ciliumVXLANDeviceName = "cilium_vxlan"
+)
+
+// Cilium is an encapsulator that is aware of Cilium's host networking devices.
+type Cilium struct {
+	iface    int
+	gw       net.IP
+	strategy Strategy
+	ch       chan netlink.LinkUpdate
+	done     chan struct{}
+	// mu guards updates to the iface and gw fields.
+	mu sync.Mutex
+}
+
+// NewCilium returns an encapsulator that uses Cilium.
+func NewCilium(strategy Strategy) Encapsulator {
+	return &Cilium{
+		ch:       make(chan netlink.LinkUpdate),
+		done:     make(chan struct{}),
+		strategy: strategy,
+	}
+}
+
+// CleanUp is a no-op.
+func (c *Cilium) CleanUp() error {
+	close(c.done)
+	return nil
+}
+
+// Gw returns the correct gateway IP associated with the given node.
+// Cilium routes pod traffic through the cilium_host address rather
+// than the first IP of the subnet, so the interface's own address is
+// used as the next-hop whenever it has been discovered.
+func (c *Cilium) Gw(_, _ net.IP, subnet *net.IPNet) net.IP {
+	c.mu.Lock()
+	gw := c.gw
+	c.mu.Unlock()
+	if gw != nil {
+		return gw
+	}
+	return subnet.IP
+}
+
+// Index returns the index of the cilium_vxlan interface.
+func (c *Cilium) Index() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.iface
+}
+
+// Init finds the Cilium interface index and the cilium_host gateway address.
+func (c *Cilium) Init(_ int) error {
+	if err := netlink.LinkSubscribe(c.ch, c.done); err != nil {
+		return fmt.Errorf("failed to subscribe to updates to %s: %v", ciliumVXLANDeviceName, err)
+	}
+	go func() {
+		var lu netlink.LinkUpdate
+		for {
+			select {
+			case lu = <-c.ch:
+				switch lu.Attrs().Name {
+				case ciliumVXLANDeviceName:
+					if lu.Header.Type == unix.RTM_DELLINK {
+						// The interface was deleted, e.g. because the
+						// Cilium agent is restarting; forget the stale
+						// index and re-resolve it the next time the
+						// device appears.
+						c.mu.Lock()
+						c.iface = 0
+						c.mu.Unlock()
+						continue
+					}
+					index := lu.Attrs().Index
+					if i, err := netlink.LinkByName(ciliumVXLANDeviceName); err == nil {
+						index = i.Attrs().Index
+					}
+					c.mu.Lock()
+					c.iface = index
+					c.mu.Unlock()
+				case ciliumHostDeviceName:
+					if lu.Header.Type == unix.RTM_DELLINK {
+						c.mu.Lock()
+						c.gw = nil
+						c.mu.Unlock()
+						continue
+					}
+					if h, err := netlink.LinkByName(ciliumHostDeviceName); err == nil {
+						c.updateGw(h)
+					}
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	i, err := netlink.LinkByName(ciliumVXLANDeviceName)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query for Cilium interface: %v", err)
+	}
+	c.mu.Lock()
+	c.iface = i.Attrs().Index
+	c.mu.Unlock()
+	if h, err := netlink.LinkByName(ciliumHostDeviceName); err == nil {
+		c.updateGw(h)
+	}
+	return nil
+}
+
+// updateGw looks up the address assigned to the given link and, if
+// present, stores it as the gateway used for Cilium-owned pod traffic.
+func (c *Cilium) updateGw(link netlink.Link) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil || len(addrs) == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.gw = addrs[0].IP
+	c.mu.Unlock()
+}
+
+// Rules is a no-op, as Cilium handles all rules for its local traffic.
+func (c *Cilium) Rules(_ []*Peer) []iptables.Rule {
+	return nil
+}
+
+// Set is a no-op.
+func (c *Cilium) Set(_ *net.IPNet) error {
+	return nil
+}
+
+// Strategy returns the configured strategy for encapsulation.
+func (c *Cilium) Strategy() Strategy {
+	return c.strategy
+}
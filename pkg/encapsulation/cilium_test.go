@@ -0,0 +1,82 @@
+// Copyright 2019 the Kilo authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encapsulation
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// TestCiliumDiscoversHostAndVXLANDevices verifies that Index tracks the
+// cilium_vxlan link and Gw returns the address assigned to cilium_host,
+// once both devices have appeared.
+func TestCiliumDiscoversHostAndVXLANDevices(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("test requires root to manipulate network namespaces")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		t.Fatalf("failed to get current netns: %v", err)
+	}
+	defer origns.Close()
+	newns, err := netns.New()
+	if err != nil {
+		t.Fatalf("failed to create netns: %v", err)
+	}
+	defer newns.Close()
+	defer netns.Set(origns)
+
+	addDummy := func(name string) netlink.Link {
+		dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}
+		if err := netlink.LinkAdd(dummy); err != nil {
+			t.Fatalf("failed to add %s: %v", name, err)
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatalf("failed to query %s: %v", name, err)
+		}
+		return link
+	}
+
+	c := NewCilium(Never).(*Cilium)
+	if err := c.Init(0); err != nil {
+		t.Fatalf("failed to initialize Cilium: %v", err)
+	}
+	defer c.CleanUp()
+
+	vxlan := addDummy(ciliumVXLANDeviceName)
+	waitFor(t, func() bool { return c.Index() == vxlan.Attrs().Index })
+
+	host := addDummy(ciliumHostDeviceName)
+	hostAddr := &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(32, 32)}
+	if err := netlink.AddrAdd(host, &netlink.Addr{IPNet: hostAddr}); err != nil {
+		t.Fatalf("failed to assign address to %s: %v", ciliumHostDeviceName, err)
+	}
+	// Assigning the address does not itself generate a link update, so
+	// bring the link up to trigger one and let the subscriber re-read it.
+	if err := netlink.LinkSetUp(host); err != nil {
+		t.Fatalf("failed to set %s up: %v", ciliumHostDeviceName, err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.244.0.0/24")
+	waitFor(t, func() bool { return c.Gw(nil, nil, subnet).Equal(hostAddr.IP) })
+}
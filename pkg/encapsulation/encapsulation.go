@@ -0,0 +1,87 @@
+// Copyright 2019 the Kilo authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encapsulation defines how Kilo encapsulates traffic between
+// locations and how it interacts with any peer CNI that already owns
+// intra-location pod networking.
+package encapsulation
+
+import (
+	"net"
+
+	"github.com/squat/kilo/pkg/iptables"
+)
+
+// Strategy defines the strategy used to encapsulate traffic.
+type Strategy string
+
+const (
+	// Never indicates that no traffic should be encapsulated.
+	Never Strategy = "never"
+	// CrossSubnet indicates that only traffic crossing
+	// a subnet boundary should be encapsulated.
+	CrossSubnet Strategy = "crosssubnet"
+	// Always indicates that all traffic should be encapsulated.
+	Always Strategy = "always"
+)
+
+// Peer carries the routing information Rules needs about a remote
+// location: its private IP address, as advertised over WireGuard, and
+// the pod subnet it owns.
+type Peer struct {
+	IP     net.IP
+	Subnet *net.IPNet
+}
+
+// Encapsulator can encapsulate packets for a given backend.
+type Encapsulator interface {
+	// CleanUp will clean up any changes made by the Encapsulator.
+	CleanUp() error
+	// Gw generates the gateway IP address for a given node's subnet.
+	Gw(net.IP, net.IP, *net.IPNet) net.IP
+	// Index returns the index of the interface used by the encapsulator.
+	Index() int
+	// Init initializes the encapsulator.
+	// It takes the index of the private IP interface as an argument.
+	Init(int) error
+	// Rules returns a set of iptables rules needed for the encapsulator.
+	Rules([]*Peer) []iptables.Rule
+	// Set configures the encapsulator to route to the given CIDR.
+	Set(*net.IPNet) error
+	// Strategy returns the configured strategy for encapsulation.
+	Strategy() Strategy
+}
+
+// NewEncapsulator returns a new encapsulator for the given backend.
+// devName and overlay are only meaningful for the kube-router backend:
+// devName is the name of the bridge device kube-router creates for the
+// cluster's pod network, and overlay indicates whether kube-router has
+// overlay mode enabled (--enable-overlay=true, in either its always or
+// crosssubnet setting). Callers that don't care about kube-router can
+// leave devName empty and overlay false.
+func NewEncapsulator(kind string, strategy Strategy, devName string, overlay bool) Encapsulator {
+	switch kind {
+	case "flannel":
+		return NewFlannel(strategy)
+	case "kube-router":
+		if devName == "" {
+			devName = kubeRouterDeviceName
+		}
+		return NewKubeRouter(strategy, devName, overlay)
+	case "cilium":
+		return NewCilium(strategy)
+	default:
+		return NewFlannel(strategy)
+	}
+}
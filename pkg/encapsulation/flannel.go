@@ -0,0 +1,127 @@
+// Copyright 2019 the Kilo authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encapsulation
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/squat/kilo/pkg/iptables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const flannelDeviceName = "flannel.1"
+
+// Flannel is an encapsulator that is aware of Flannel's VXLAN interface.
+type Flannel struct {
+	iface    int
+	strategy Strategy
+	ch       chan netlink.LinkUpdate
+	done     chan struct{}
+	// mu guards updates to the iface field.
+	mu sync.Mutex
+}
+
+// NewFlannel returns an encapsulator that uses Flannel.
+func NewFlannel(strategy Strategy) Encapsulator {
+	return &Flannel{
+		ch:       make(chan netlink.LinkUpdate),
+		done:     make(chan struct{}),
+		strategy: strategy,
+	}
+}
+
+// CleanUp is a no-op.
+func (f *Flannel) CleanUp() error {
+	close(f.done)
+	return nil
+}
+
+// Gw returns the correct gateway IP associated with the given node.
+func (f *Flannel) Gw(_, _ net.IP, subnet *net.IPNet) net.IP {
+	return subnet.IP
+}
+
+// Index returns the index of the Flannel interface.
+func (f *Flannel) Index() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.iface
+}
+
+// Init finds the Flannel interface index.
+func (f *Flannel) Init(_ int) error {
+	if err := netlink.LinkSubscribe(f.ch, f.done); err != nil {
+		return fmt.Errorf("failed to subscribe to updates to %s: %v", flannelDeviceName, err)
+	}
+	go func() {
+		var lu netlink.LinkUpdate
+		for {
+			select {
+			case lu = <-f.ch:
+				if lu.Attrs().Name != flannelDeviceName {
+					continue
+				}
+				switch lu.Header.Type {
+				case unix.RTM_DELLINK:
+					// The interface was deleted, e.g. because flanneld is
+					// restarting; forget the stale index and re-resolve it
+					// the next time the device appears.
+					f.mu.Lock()
+					f.iface = 0
+					f.mu.Unlock()
+				case unix.RTM_NEWLINK:
+					index := lu.Attrs().Index
+					if i, err := netlink.LinkByName(flannelDeviceName); err == nil {
+						index = i.Attrs().Index
+					}
+					f.mu.Lock()
+					f.iface = index
+					f.mu.Unlock()
+				}
+			case <-f.done:
+				return
+			}
+		}
+	}()
+	i, err := netlink.LinkByName(flannelDeviceName)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query for Flannel interface: %v", err)
+	}
+	f.mu.Lock()
+	f.iface = i.Attrs().Index
+	f.mu.Unlock()
+	return nil
+}
+
+// Rules is a no-op.
+func (f *Flannel) Rules(_ []*Peer) []iptables.Rule {
+	return nil
+}
+
+// Set is a no-op.
+func (f *Flannel) Set(_ *net.IPNet) error {
+	return nil
+}
+
+// Strategy returns the configured strategy for encapsulation.
+func (f *Flannel) Strategy() Strategy {
+	return f.strategy
+}
@@ -18,25 +18,53 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/squat/kilo/pkg/iptables"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-const kubeRouterDeviceName = "kube-bridge"
+const (
+	kubeRouterDeviceName       = "kube-bridge"
+	kubeRouterTunnelDeviceName = "tunl0"
+	// tunnelRescanInterval is how often the tunnel interfaces kube-router
+	// creates on first contact with a peer are re-scanned, since they are
+	// not created until kube-router's overlay mode actually needs them.
+	tunnelRescanInterval = 30 * time.Second
+)
 
 type KubeRouter struct {
 	iface    int
+	devName  string
 	strategy Strategy
-	ch       chan netlink.LinkUpdate
-	done     chan struct{}
-	// mu guards updates to the iface field.
+	// overlay mirrors kube-router's own --enable-overlay setting and
+	// controls whether IPIP/FoU tunnels are taken into account at all.
+	// kube-router itself is responsible for the always/crosssubnet
+	// distinction; from Kilo's side there is only "tunnels may exist" or
+	// "tunnels are irrelevant", hence a bool rather than a Strategy.
+	overlay bool
+	// tunnels maps the remote address of a kube-router IPIP/FoU tunnel to
+	// the local address of that tunnel, i.e. the gateway local traffic
+	// must be sent to in order to reach that remote node via the tunnel.
+	tunnels map[string]net.IP
+	ch      chan netlink.LinkUpdate
+	done    chan struct{}
+	// mu guards updates to the iface and tunnels fields.
 	mu sync.Mutex
 }
 
 // NewKubeRouter returns an encapsulator that uses kube-router.
-func NewKubeRouter(strategy Strategy) Encapsulator {
+// devName is the name of the bridge device kube-router creates for the
+// cluster's pod network, e.g. kube-bridge. overlay indicates whether
+// kube-router has overlay mode enabled (--enable-overlay=true, in either
+// its always or crosssubnet setting) and so may have established
+// IPIP/FoU tunnels to peers that Kilo needs to route through.
+func NewKubeRouter(strategy Strategy, devName string, overlay bool) Encapsulator {
 	return &KubeRouter{
+		devName:  devName,
+		overlay:  overlay,
+		tunnels:  make(map[string]net.IP),
 		ch:       make(chan netlink.LinkUpdate),
 		done:     make(chan struct{}),
 		strategy: strategy,
@@ -50,36 +78,63 @@ func (f *KubeRouter) CleanUp() error {
 }
 
 // Gw returns the correct gateway IP associated with the given node.
-func (f *KubeRouter) Gw(_, _ net.IP, subnet *net.IPNet) net.IP {
+// If kube-router has established an IPIP/FoU tunnel to the node, the
+// tunnel's local address is returned so that traffic is routed through
+// the tunnel rather than directly over the underlay.
+func (f *KubeRouter) Gw(_, dst net.IP, subnet *net.IPNet) net.IP {
+	if f.overlay && dst != nil {
+		f.mu.Lock()
+		gw, ok := f.tunnels[dst.String()]
+		f.mu.Unlock()
+		if ok {
+			return gw
+		}
+	}
 	return subnet.IP
 }
 
 // Index returns the index of the kube-router interface.
 func (f *KubeRouter) Index() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.iface
 }
 
-// Init finds the kubeRouter interface index.
+// Init finds the kubeRouter interface index and, when overlay mode is
+// enabled, starts scanning for the IPIP/FoU tunnels kube-router creates
+// lazily on first contact with a peer.
 func (f *KubeRouter) Init(_ int) error {
 	if err := netlink.LinkSubscribe(f.ch, f.done); err != nil {
-		return fmt.Errorf("failed to subscribe to updates to %s: %v", kubeRouterDeviceName, err)
+		return fmt.Errorf("failed to subscribe to updates to %s: %v", f.devName, err)
 	}
 	go func() {
 		var lu netlink.LinkUpdate
+		var ticker *time.Ticker
+		var tick <-chan time.Time
+		if f.overlay {
+			ticker = time.NewTicker(tunnelRescanInterval)
+			tick = ticker.C
+			defer ticker.Stop()
+		}
 		for {
 			select {
 			case lu = <-f.ch:
-				if lu.Attrs().Name == kubeRouterDeviceName {
-					f.mu.Lock()
-					f.iface = lu.Attrs().Index
-					f.mu.Unlock()
+				if lu.Attrs().Name == f.devName {
+					f.handleBridgeUpdate(lu)
 				}
+				// Other link updates, e.g. the veth pairs created and
+				// destroyed as pods come and go, are ignored here; tunnel
+				// discovery relies solely on the periodic rescan below
+				// since kube-router tunnels are created lazily and rare
+				// compared to routine pod churn.
+			case <-tick:
+				f.scanTunnels()
 			case <-f.done:
 				return
 			}
 		}
 	}()
-	i, err := netlink.LinkByName(kubeRouterDeviceName)
+	i, err := netlink.LinkByName(f.devName)
 	if _, ok := err.(netlink.LinkNotFoundError); ok {
 		return nil
 	}
@@ -89,12 +144,97 @@ func (f *KubeRouter) Init(_ int) error {
 	f.mu.Lock()
 	f.iface = i.Attrs().Index
 	f.mu.Unlock()
+	if f.overlay {
+		f.scanTunnels()
+	}
 	return nil
 }
 
-// Rules is a no-op.
-func (f *KubeRouter) Rules(_ []*net.IPNet) []iptables.Rule {
-	return nil
+// handleBridgeUpdate keeps f.iface in sync with the lifecycle of the
+// kube-router bridge, re-resolving its index whenever the device is
+// recreated rather than trusting a possibly stale link update.
+func (f *KubeRouter) handleBridgeUpdate(lu netlink.LinkUpdate) {
+	switch lu.Header.Type {
+	case unix.RTM_DELLINK:
+		f.mu.Lock()
+		f.iface = 0
+		f.mu.Unlock()
+	case unix.RTM_NEWLINK:
+		index := lu.Attrs().Index
+		if i, err := netlink.LinkByName(f.devName); err == nil {
+			index = i.Attrs().Index
+		}
+		f.mu.Lock()
+		f.iface = index
+		f.mu.Unlock()
+	}
+}
+
+// scanTunnels looks for IPIP tunnels that kube-router has created to reach
+// peers in overlay mode, i.e. links of type ipip whose parent is tunl0, and
+// records the local address each one uses as the gateway for its remote.
+func (f *KubeRouter) scanTunnels() {
+	// Without a tunl0 device, kube-router has not enabled overlay mode on
+	// this node and cannot have created any per-peer tunnels; bail out
+	// rather than comparing ParentIndex against a zero value, which would
+	// misclassify any unrelated standalone ipip tunnel on the box as a
+	// kube-router tunnel.
+	tunl0, err := netlink.LinkByName(kubeRouterTunnelDeviceName)
+	if err != nil {
+		return
+	}
+	tunl0Index := tunl0.Attrs().Index
+	links, err := netlink.LinkList()
+	if err != nil {
+		return
+	}
+	tunnels := make(map[string]net.IP)
+	for _, link := range links {
+		// tunl0 itself is the template device kube-router hangs per-peer
+		// tunnels off of; it is never itself one of those peer tunnels.
+		if link.Attrs().Name == kubeRouterTunnelDeviceName {
+			continue
+		}
+		ipip, ok := link.(*netlink.Iptun)
+		if !ok {
+			continue
+		}
+		if link.Attrs().ParentIndex != tunl0Index {
+			continue
+		}
+		if ipip.Remote == nil || ipip.Local == nil {
+			continue
+		}
+		tunnels[ipip.Remote.String()] = ipip.Local
+	}
+	f.mu.Lock()
+	f.tunnels = tunnels
+	f.mu.Unlock()
+}
+
+// Rules exempts traffic to peers that kube-router has already encapsulated
+// in an IPIP/FoU tunnel from Kilo's masquerade chain, since kube-router
+// handles NAT for its own overlay traffic. Peers kube-router has not (yet)
+// tunneled, e.g. same-subnet peers or a crosssubnet peer with no tunnel
+// established, are left subject to Kilo's normal masquerade rules.
+func (f *KubeRouter) Rules(peers []*Peer) []iptables.Rule {
+	if !f.overlay {
+		return nil
+	}
+	f.mu.Lock()
+	tunnels := f.tunnels
+	f.mu.Unlock()
+	var rules []iptables.Rule
+	for _, peer := range peers {
+		if peer.IP == nil {
+			continue
+		}
+		if _, ok := tunnels[peer.IP.String()]; !ok {
+			continue
+		}
+		rules = append(rules, iptables.NewIPTablesRule("nat", "KILO-NAT", "-d", peer.Subnet.String(), "-j", "RETURN"))
+	}
+	return rules
 }
 
 // Set is a no-op.
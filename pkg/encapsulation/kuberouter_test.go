@@ -0,0 +1,189 @@
+// Copyright 2019 the Kilo authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encapsulation
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// TestKubeRouterReDetectsRecreatedBridge verifies that Index keeps tracking
+// the devName link when it is deleted and recreated, as happens when
+// kube-router is upgraded or switches between overlay and underlay modes.
+func TestKubeRouterReDetectsRecreatedBridge(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("test requires root to manipulate network namespaces")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		t.Fatalf("failed to get current netns: %v", err)
+	}
+	defer origns.Close()
+	newns, err := netns.New()
+	if err != nil {
+		t.Fatalf("failed to create netns: %v", err)
+	}
+	defer newns.Close()
+	defer netns.Set(origns)
+
+	const devName = "kube-bridge"
+	addBridge := func() int {
+		br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: devName}}
+		if err := netlink.LinkAdd(br); err != nil {
+			t.Fatalf("failed to add bridge: %v", err)
+		}
+		link, err := netlink.LinkByName(devName)
+		if err != nil {
+			t.Fatalf("failed to query bridge: %v", err)
+		}
+		return link.Attrs().Index
+	}
+
+	kr := NewKubeRouter(Never, devName, false).(*KubeRouter)
+	if err := kr.Init(0); err != nil {
+		t.Fatalf("failed to initialize KubeRouter: %v", err)
+	}
+	defer kr.CleanUp()
+
+	firstIndex := addBridge()
+	waitFor(t, func() bool { return kr.Index() == firstIndex })
+
+	if err := netlink.LinkDel(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: devName}}); err != nil {
+		t.Fatalf("failed to delete bridge: %v", err)
+	}
+	waitFor(t, func() bool { return kr.Index() == 0 })
+
+	secondIndex := addBridge()
+	if secondIndex == firstIndex {
+		t.Fatalf("expected recreated bridge to get a new index")
+	}
+	waitFor(t, func() bool { return kr.Index() == secondIndex })
+}
+
+// waitFor polls cond until it is true or fails the test after a timeout.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("condition not met before timeout")
+}
+
+func TestKubeRouterGw(t *testing.T) {
+	tunneled := net.ParseIP("10.0.1.1")
+	tunnelLocal := net.ParseIP("172.16.0.1")
+	untunneled := net.ParseIP("10.0.2.1")
+	_, subnet, _ := net.ParseCIDR("10.0.2.0/24")
+
+	for _, tc := range []struct {
+		name    string
+		overlay bool
+		dst     net.IP
+		want    net.IP
+	}{
+		{
+			name:    "overlay disabled falls back to subnet",
+			overlay: false,
+			dst:     tunneled,
+			want:    subnet.IP,
+		},
+		{
+			name:    "tunneled peer returns tunnel local address",
+			overlay: true,
+			dst:     tunneled,
+			want:    tunnelLocal,
+		},
+		{
+			name:    "untunneled peer falls back to subnet",
+			overlay: true,
+			dst:     untunneled,
+			want:    subnet.IP,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kr := &KubeRouter{
+				overlay: tc.overlay,
+				tunnels: map[string]net.IP{tunneled.String(): tunnelLocal},
+			}
+			if got := kr.Gw(nil, tc.dst, subnet); !got.Equal(tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestKubeRouterRules(t *testing.T) {
+	tunneled := net.ParseIP("10.0.1.1")
+	tunnelLocal := net.ParseIP("172.16.0.1")
+	untunneled := net.ParseIP("10.0.2.1")
+	_, tunneledSubnet, _ := net.ParseCIDR("10.0.1.0/24")
+	_, untunneledSubnet, _ := net.ParseCIDR("10.0.2.0/24")
+
+	for _, tc := range []struct {
+		name      string
+		overlay   bool
+		tunnels   map[string]net.IP
+		peers     []*Peer
+		wantRules int
+	}{
+		{
+			name:      "overlay disabled produces no rules",
+			overlay:   false,
+			tunnels:   map[string]net.IP{tunneled.String(): tunnelLocal},
+			peers:     []*Peer{{IP: tunneled, Subnet: tunneledSubnet}},
+			wantRules: 0,
+		},
+		{
+			name:    "only tunneled peers are exempted",
+			overlay: true,
+			tunnels: map[string]net.IP{tunneled.String(): tunnelLocal},
+			peers: []*Peer{
+				{IP: tunneled, Subnet: tunneledSubnet},
+				{IP: untunneled, Subnet: untunneledSubnet},
+			},
+			wantRules: 1,
+		},
+		{
+			name:      "no tunnels discovered yet means no rules even with overlay enabled",
+			overlay:   true,
+			tunnels:   map[string]net.IP{},
+			peers:     []*Peer{{IP: untunneled, Subnet: untunneledSubnet}},
+			wantRules: 0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kr := &KubeRouter{
+				overlay: tc.overlay,
+				tunnels: tc.tunnels,
+			}
+			if got := len(kr.Rules(tc.peers)); got != tc.wantRules {
+				t.Errorf("got %d rules, want %d", got, tc.wantRules)
+			}
+		})
+	}
+}